@@ -0,0 +1,189 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBlobCacheSize               = 100_000
+	defaultBlobCachePositiveTTL        = 24 * time.Hour
+	defaultBlobCacheNegativeInitialTTL = 120 * time.Second
+	defaultBlobCacheNegativeTTLStep    = 5 * time.Second
+	defaultBlobCacheNegativeMaxTTL     = time.Hour
+)
+
+// blobCacheConfig controls the size and TTLs of a blobCache. Zero values
+// fall back to the defaults above.
+type blobCacheConfig struct {
+	Size               int
+	PositiveTTL        time.Duration
+	NegativeInitialTTL time.Duration
+	NegativeTTLStep    time.Duration
+	NegativeMaxTTL     time.Duration
+}
+
+func (cfg blobCacheConfig) withDefaults() blobCacheConfig {
+	if cfg.Size <= 0 {
+		cfg.Size = defaultBlobCacheSize
+	}
+	if cfg.PositiveTTL <= 0 {
+		cfg.PositiveTTL = defaultBlobCachePositiveTTL
+	}
+	if cfg.NegativeInitialTTL <= 0 {
+		cfg.NegativeInitialTTL = defaultBlobCacheNegativeInitialTTL
+	}
+	if cfg.NegativeTTLStep <= 0 {
+		cfg.NegativeTTLStep = defaultBlobCacheNegativeTTLStep
+	}
+	if cfg.NegativeMaxTTL <= 0 {
+		cfg.NegativeMaxTTL = defaultBlobCacheNegativeMaxTTL
+	}
+	return cfg
+}
+
+// cacheEntry is a single cached blob-existence result.
+type cacheEntry struct {
+	key       string
+	exists    bool
+	expiresAt time.Time
+	// missStreak counts consecutive negative results seen for this key,
+	// including ones that have since expired, so a perennially-missing
+	// blob keeps backing off its TTL rather than resetting to
+	// NegativeInitialTTL every time the previous entry expires.
+	missStreak int
+	// label is the metrics label (cloud or backend name) this entry was
+	// cached under, recorded at Put time so evictOldest can attribute an
+	// eviction to its actual source instead of a single hardcoded one.
+	label string
+}
+
+// blobCache is a bounded LRU cache of blob-existence results.
+//
+// Positive results are cached for a long, fixed TTL: once a blob exists it
+// is not expected to disappear. Negative results use a short TTL that
+// backs off (+NegativeTTLStep per repeated miss, capped at NegativeMaxTTL)
+// so a client repeatedly requesting a blob that will never exist doesn't
+// cause an upstream HEAD on every single request, while a blob that just
+// finished uploading doesn't look unavailable for too long.
+type blobCache struct {
+	cfg     blobCacheConfig
+	metrics *metrics
+
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	evictList *list.List // front = most recently used
+}
+
+func newBlobCache(cfg blobCacheConfig, m *metrics) *blobCache {
+	return &blobCache{
+		cfg:       cfg.withDefaults(),
+		metrics:   m,
+		items:     make(map[string]*list.Element),
+		evictList: list.New(),
+	}
+}
+
+// Get returns the cached result for blobURL and whether an unexpired entry
+// was found at all.
+func (b *blobCache) Get(blobURL string) (exists bool, found bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	el, ok := b.items[blobURL]
+	if !ok {
+		return false, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		return false, false
+	}
+	b.evictList.MoveToFront(el)
+	return entry.exists, true
+}
+
+// PutPositive records that key exists, for cfg.PositiveTTL. label is the
+// metrics label (cloud or backend name) to attribute a future eviction of
+// this entry to.
+func (b *blobCache) PutPositive(key, label string) {
+	b.put(key, label, true)
+}
+
+// PutNegative records that key does not exist, backing off the TTL each
+// time the same key is recorded as missing again. label is the metrics
+// label to attribute a future eviction of this entry to.
+func (b *blobCache) PutNegative(key, label string) {
+	b.put(key, label, false)
+}
+
+func (b *blobCache) put(key, label string, exists bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if exists {
+			entry.missStreak = 0
+		} else {
+			entry.missStreak++
+		}
+		entry.exists = exists
+		entry.label = label
+		entry.expiresAt = b.expiry(exists, entry.missStreak)
+		b.evictList.MoveToFront(el)
+		return
+	}
+
+	entry := &cacheEntry{key: key, label: label, exists: exists}
+	if !exists {
+		entry.missStreak = 1
+	}
+	entry.expiresAt = b.expiry(exists, entry.missStreak)
+	el := b.evictList.PushFront(entry)
+	b.items[key] = el
+
+	if b.evictList.Len() > b.cfg.Size {
+		b.evictOldest()
+	}
+}
+
+func (b *blobCache) expiry(exists bool, missStreak int) time.Time {
+	if exists {
+		return time.Now().Add(b.cfg.PositiveTTL)
+	}
+	ttl := b.cfg.NegativeInitialTTL + time.Duration(missStreak-1)*b.cfg.NegativeTTLStep
+	if ttl > b.cfg.NegativeMaxTTL {
+		ttl = b.cfg.NegativeMaxTTL
+	}
+	return time.Now().Add(ttl)
+}
+
+// evictOldest drops the least-recently-used entry. Callers must hold b.mu.
+func (b *blobCache) evictOldest() {
+	el := b.evictList.Back()
+	if el == nil {
+		return
+	}
+	entry := el.Value.(*cacheEntry)
+	b.evictList.Remove(el)
+	delete(b.items, entry.key)
+	if b.metrics != nil {
+		b.metrics.blobCacheEvictionsTotal.WithLabelValues(entry.label).Inc()
+	}
+}
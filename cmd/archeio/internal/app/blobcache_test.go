@@ -0,0 +1,140 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBlobCacheGetMiss(t *testing.T) {
+	b := newBlobCache(blobCacheConfig{}, nil)
+	if _, found := b.Get("https://example.com/blob"); found {
+		t.Fatal("expected miss on empty cache")
+	}
+}
+
+func TestBlobCachePositiveTTL(t *testing.T) {
+	b := newBlobCache(blobCacheConfig{PositiveTTL: 20 * time.Millisecond}, nil)
+	b.PutPositive("https://example.com/blob", "AWS")
+
+	if exists, found := b.Get("https://example.com/blob"); !found || !exists {
+		t.Fatalf("expected cached positive hit, got exists=%v found=%v", exists, found)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, found := b.Get("https://example.com/blob"); found {
+		t.Fatal("expected positive entry to have expired")
+	}
+}
+
+func TestBlobCacheNegativeBackoff(t *testing.T) {
+	b := newBlobCache(blobCacheConfig{
+		NegativeInitialTTL: time.Second,
+		NegativeTTLStep:    time.Second,
+		NegativeMaxTTL:     3 * time.Second,
+	}, nil)
+
+	// first miss: missStreak 1, ttl == NegativeInitialTTL
+	if got := b.expiry(false, 1).Sub(time.Now()).Round(time.Second); got != time.Second {
+		t.Fatalf("missStreak=1: expected ~1s ttl, got %v", got)
+	}
+	// second consecutive miss: ttl steps up
+	if got := b.expiry(false, 2).Sub(time.Now()).Round(time.Second); got != 2*time.Second {
+		t.Fatalf("missStreak=2: expected ~2s ttl, got %v", got)
+	}
+	// backoff is capped at NegativeMaxTTL no matter how long the streak gets
+	if got := b.expiry(false, 10).Sub(time.Now()).Round(time.Second); got != 3*time.Second {
+		t.Fatalf("missStreak=10: expected ttl capped at 3s, got %v", got)
+	}
+}
+
+func TestBlobCacheNegativeBackoffPersistsAcrossExpiry(t *testing.T) {
+	b := newBlobCache(blobCacheConfig{
+		NegativeInitialTTL: 10 * time.Millisecond,
+		NegativeTTLStep:    time.Hour, // large step makes the second TTL easy to distinguish
+	}, nil)
+
+	b.PutNegative("https://example.com/blob", "AWS")
+	time.Sleep(20 * time.Millisecond) // let the first negative entry expire
+
+	if _, found := b.Get("https://example.com/blob"); found {
+		t.Fatal("expected first negative entry to have expired")
+	}
+
+	// a second miss on the same key should back off from missStreak=1,
+	// not reset to NegativeInitialTTL as if it were a brand new key
+	b.PutNegative("https://example.com/blob", "AWS")
+	el := b.items["https://example.com/blob"]
+	entry := el.Value.(*cacheEntry)
+	if entry.missStreak != 2 {
+		t.Fatalf("expected missStreak to keep counting across expiry, got %d", entry.missStreak)
+	}
+}
+
+func TestBlobCachePositiveResetsMissStreak(t *testing.T) {
+	b := newBlobCache(blobCacheConfig{}, nil)
+	b.PutNegative("https://example.com/blob", "AWS")
+	b.PutNegative("https://example.com/blob", "AWS")
+	b.PutPositive("https://example.com/blob", "AWS")
+
+	el := b.items["https://example.com/blob"]
+	entry := el.Value.(*cacheEntry)
+	if entry.missStreak != 0 {
+		t.Fatalf("expected a positive result to reset missStreak, got %d", entry.missStreak)
+	}
+}
+
+func TestBlobCacheEvictionAttributedToEntryLabel(t *testing.T) {
+	m := newMetrics()
+	b := newBlobCache(blobCacheConfig{Size: 1}, m)
+
+	b.PutPositive("s3:digest-a", "s3-mirror")
+	b.PutPositive("gcs:digest-b", "gcs-mirror") // exceeds Size=1, evicts the s3 entry
+
+	if got := testutil.ToFloat64(m.blobCacheEvictionsTotal.WithLabelValues("s3-mirror")); got != 1 {
+		t.Fatalf("expected 1 eviction labeled s3-mirror, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.blobCacheEvictionsTotal.WithLabelValues("gcs-mirror")); got != 0 {
+		t.Fatalf("expected 0 evictions labeled gcs-mirror, got %v", got)
+	}
+}
+
+func TestBlobCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	b := newBlobCache(blobCacheConfig{Size: 2}, nil)
+	b.PutPositive("a", "AWS")
+	b.PutPositive("b", "AWS")
+
+	// touch "a" so "b" becomes the least recently used entry
+	if _, found := b.Get("a"); !found {
+		t.Fatal("expected a to be cached")
+	}
+
+	b.PutPositive("c", "AWS") // exceeds Size=2, should evict "b"
+
+	if _, found := b.Get("b"); found {
+		t.Fatal("expected b to have been evicted as least recently used")
+	}
+	if _, found := b.Get("a"); !found {
+		t.Fatal("expected a to survive eviction (recently touched)")
+	}
+	if _, found := b.Get("c"); !found {
+		t.Fatal("expected c to be cached")
+	}
+}
@@ -17,11 +17,14 @@ limitations under the License.
 package app
 
 import (
+	"context"
 	"net/http"
-	"sync"
 	"time"
 
+	"golang.org/x/sync/singleflight"
 	"k8s.io/klog/v2"
+
+	"k8s.io/registry.k8s.io/pkg/backend"
 )
 
 // awsRegionToHostURL returns the base S3 bucket URL for an OCI layer blob given the AWS region
@@ -49,57 +52,130 @@ type blobChecker interface {
 	// BlobExists should check that blobURL exists
 	// bucket and layerHash may be used for caching purposes
 	BlobExists(blobURL string) bool
+	// BackendBlobExists checks whether digest exists in backend b, sharing
+	// the same cache and singleflight coalescing as BlobExists so adopting
+	// a pluggable backend doesn't reintroduce an uncached, uncoalesced hot
+	// path to the backend's SDK.
+	BackendBlobExists(ctx context.Context, b backend.Backend, digest string) (bool, error)
 }
 
-// cachedBlobChecker just performs an HTTP HEAD check against the blob
-//
-// TODO: potentially replace with a caching implementation
-// should be plenty fast for now, HTTP HEAD on s3 is cheap
-type cachedBlobChecker struct {
-	blobCache
-}
-
-func newCachedBlobChecker() *cachedBlobChecker {
-	return &cachedBlobChecker{}
-}
-
-type blobCache struct {
-	m sync.Map
-}
+// blobCheckerCloud is the cloud label attached to BlobExists metrics, which
+// only ever checks AWS-backed buckets. BackendBlobExists labels its metrics
+// with the backend's name instead.
+const blobCheckerCloud = "AWS"
 
-func (b *blobCache) Get(blobURL string) bool {
-	_, exists := b.m.Load(blobURL)
-	return exists
+// cachedBlobChecker performs an HTTP HEAD check against the blob, caching
+// results in a blobCache and coalescing concurrent checks for the same
+// blobURL via singleflight so a thundering herd of requests for the same
+// digest only issues one HEAD.
+type cachedBlobChecker struct {
+	cache   *blobCache
+	metrics *metrics
+	group   singleflight.Group
 }
 
-func (b *blobCache) Put(blobURL string) {
-	b.m.Store(blobURL, struct{}{})
+func newCachedBlobChecker(m *metrics, cfg blobCacheConfig) *cachedBlobChecker {
+	return &cachedBlobChecker{
+		cache:   newBlobCache(cfg, m),
+		metrics: m,
+	}
 }
 
 func (c *cachedBlobChecker) BlobExists(blobURL string) bool {
-	if c.blobCache.Get(blobURL) {
+	if exists, found := c.cache.Get(blobURL); found {
 		klog.V(3).InfoS("blob existence cache hit", "url", blobURL)
-		return true
+		c.metrics.blobCacheHitsTotal.WithLabelValues(blobCheckerCloud).Inc()
+		return exists
 	}
 	klog.V(3).InfoS("blob existence cache miss", "url", blobURL)
+	c.metrics.blobCacheMissesTotal.WithLabelValues(blobCheckerCloud).Inc()
+
+	// coalesce concurrent lookups for the same blobURL into a single HEAD
+	v, _, _ := c.group.Do(blobURL, func() (interface{}, error) {
+		return c.checkUpstream(blobURL), nil
+	})
+	return v.(bool)
+}
+
+// checkUpstream issues the actual HEAD request and caches the result.
+// It is only ever run once at a time per blobURL, via c.group.
+func (c *cachedBlobChecker) checkUpstream(blobURL string) bool {
 	// NOTE: this client will still share http.DefaultTransport
 	// We do not wish to share the rest of the client state currently
 	client := &http.Client{
 		// ensure sensible timeouts
 		Timeout: time.Second * 5,
 	}
+	start := time.Now()
 	r, err := client.Head(blobURL)
-	// fallback to assuming blob is unavailable on errors
+	c.metrics.blobHeadDuration.WithLabelValues(blobCheckerCloud).Observe(time.Since(start).Seconds())
+	// fallback to assuming blob is unavailable on errors, but don't cache
+	// the negative result: this is presumed to be a transient failure
+	// (network blip, backend hiccup), not evidence the blob is missing.
 	if err != nil {
 		klog.Errorf("failed to HEAD %s: %v", blobURL, err)
+		c.metrics.blobHeadFailureTotal.WithLabelValues(blobCheckerCloud).Inc()
 		return false
 	}
 	r.Body.Close()
 	// if the blob exists it HEAD should return 200 OK
 	// this is true for S3 and for OCI registries
 	if r.StatusCode == http.StatusOK {
-		c.blobCache.Put(blobURL)
+		c.cache.PutPositive(blobURL, blobCheckerCloud)
 		return true
 	}
+	c.cache.PutNegative(blobURL, blobCheckerCloud)
 	return false
 }
+
+// backendCacheKey namespaces cache/singleflight keys for BackendBlobExists
+// by backend name, so the same digest mirrored by two different backends
+// (or a digest that happens to collide with a legacy blobURL) caches and
+// coalesces independently.
+func backendCacheKey(backendName, digest string) string {
+	return "backend:" + backendName + ":" + digest
+}
+
+// BackendBlobExists checks whether digest exists in backend b, using the
+// same blobCache and singleflight.Group as BlobExists: a cache hit avoids
+// the SDK call entirely, and concurrent misses for the same (backend,
+// digest) coalesce into a single upstream check.
+func (c *cachedBlobChecker) BackendBlobExists(ctx context.Context, b backend.Backend, digest string) (bool, error) {
+	key := backendCacheKey(b.Name(), digest)
+	if exists, found := c.cache.Get(key); found {
+		klog.V(3).InfoS("blob existence cache hit", "backend", b.Name(), "digest", digest)
+		c.metrics.blobCacheHitsTotal.WithLabelValues(b.Name()).Inc()
+		return exists, nil
+	}
+	klog.V(3).InfoS("blob existence cache miss", "backend", b.Name(), "digest", digest)
+	c.metrics.blobCacheMissesTotal.WithLabelValues(b.Name()).Inc()
+
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		return c.checkBackendUpstream(ctx, b, digest, key)
+	})
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// checkBackendUpstream issues the actual backend SDK existence check and
+// caches the result. It is only ever run once at a time per (backend,
+// digest), via c.group.
+func (c *cachedBlobChecker) checkBackendUpstream(ctx context.Context, b backend.Backend, digest, key string) (bool, error) {
+	start := time.Now()
+	exists, err := b.BlobExists(ctx, digest)
+	c.metrics.blobHeadDuration.WithLabelValues(b.Name()).Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.metrics.blobHeadFailureTotal.WithLabelValues(b.Name()).Inc()
+		// don't cache errors: presumed to be a transient failure, not
+		// evidence the blob is missing.
+		return false, err
+	}
+	if exists {
+		c.cache.PutPositive(key, b.Name())
+	} else {
+		c.cache.PutNegative(key, b.Name())
+	}
+	return exists, nil
+}
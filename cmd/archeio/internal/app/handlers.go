@@ -17,13 +17,17 @@ limitations under the License.
 package app
 
 import (
+	"context"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 
+	"k8s.io/registry.k8s.io/pkg/backend"
 	"k8s.io/registry.k8s.io/pkg/net/clientip"
 	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
 )
@@ -35,6 +39,42 @@ type RegistryConfig struct {
 	InfoURL              string
 	PrivacyURL           string
 	DefaultAWSBaseURL    string
+	// BackendsConfigPath, if set, points at a YAML/JSON file describing
+	// the pluggable blob-mirror backends (S3, Azure Blob, GCS, OCI) to
+	// check and redirect to. When unset, archeio falls back to its
+	// legacy AWS-only behavior driven by DefaultAWSBaseURL.
+	BackendsConfigPath string
+
+	// BlobCache* configure the size and TTLs of the blob existence cache.
+	// Zero values fall back to sensible defaults; see blobCacheConfig.
+	BlobCacheSize               int
+	BlobCachePositiveTTL        time.Duration
+	BlobCacheNegativeInitialTTL time.Duration
+	BlobCacheNegativeTTLStep    time.Duration
+	BlobCacheNegativeMaxTTL     time.Duration
+
+	// PresignExpiry is how long a presigned blob redirect URL is valid
+	// for, for backends that implement backend.Presigner. Zero falls
+	// back to backend.DefaultPresignExpiry.
+	PresignExpiry time.Duration
+
+	// CIDRRefreshInterval, CIDRAWSURL, CIDRGCPURL, and CIDRAzureURL
+	// configure the background refresher that keeps cloud IP range data
+	// current without a redeploy. See cloudcidrs.RefreshConfig for
+	// defaults and the zero-value behavior of each field.
+	CIDRRefreshInterval time.Duration
+	CIDRAWSURL          string
+	CIDRGCPURL          string
+	CIDRAzureURL        string
+
+	// TrustedProxyCIDRs allowlists the proxies archeio will trust to set
+	// an accurate X-Forwarded-For header, and to set the X-Client-Region
+	// / X-Client-Cloud and EDNS-client-subnet-hint override headers. An
+	// empty list means no proxy is trusted and all of these are ignored.
+	TrustedProxyCIDRs []netip.Prefix
+	// EDNSSubnetHeader names the EDNS client-subnet-like hint header a
+	// trusted CDN front sets. Defaults to cloudcidrs.DefaultEDNSSubnetHeader.
+	EDNSSubnetHeader string
 }
 
 // MakeHandler returns the root archeio HTTP handler
@@ -44,9 +84,20 @@ type RegistryConfig struct {
 //
 // Exact behavior should be documented in docs/request-handling.md
 func MakeHandler(rc RegistryConfig) http.Handler {
-	blobs := newCachedBlobChecker()
-	doV2 := makeV2Handler(rc, blobs)
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	m := newMetrics()
+	blobs := newCachedBlobChecker(m, blobCacheConfig{
+		Size:               rc.BlobCacheSize,
+		PositiveTTL:        rc.BlobCachePositiveTTL,
+		NegativeInitialTTL: rc.BlobCacheNegativeInitialTTL,
+		NegativeTTLStep:    rc.BlobCacheNegativeTTLStep,
+		NegativeMaxTTL:     rc.BlobCacheNegativeMaxTTL,
+	})
+	doV2 := m.instrumentResponses(makeV2Handler(rc, blobs, m))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.metricsHandler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		klog.Infof("Handling request: %s %s", r.Method, r.URL.Path)
 		// only allow GET, HEAD
 		// this is all a client needs to pull images
@@ -70,9 +121,10 @@ func MakeHandler(rc RegistryConfig) http.Handler {
 			http.NotFound(w, r)
 		}
 	})
+	return mux
 }
 
-func makeV2Handler(rc RegistryConfig, blobs blobChecker) func(w http.ResponseWriter, r *http.Request) {
+func makeV2Handler(rc RegistryConfig, blobs blobChecker, m *metrics) func(w http.ResponseWriter, r *http.Request) {
 	// matches blob requests, captures the requested blob hash
 	// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pull
 	// Blobs are at `/v2/<name>/blobs/<digest>`
@@ -80,22 +132,52 @@ func makeV2Handler(rc RegistryConfig, blobs blobChecker) func(w http.ResponseWri
 	// <digest> also cannot contain `/` so we can use a relatively simple and cheap regex
 	// to match blob requests and capture the digest
 	reBlob := regexp.MustCompile("^/v2/.*/blobs/([^/]+:[a-zA-Z0-9=_-]+)$")
-	// initialize map of clientIP to AWS region
-	regionMapper := cloudcidrs.NewIPMapper()
+	// initialize map of clientIP to cloud region, refreshed in the
+	// background so new cloud IP ranges don't require a redeploy
+	regionMapper, err := cloudcidrs.NewAutoRefreshingIPMapper(cloudcidrs.RefreshConfig{
+		Interval: rc.CIDRRefreshInterval,
+		AWSURL:   rc.CIDRAWSURL,
+		GCPURL:   rc.CIDRGCPURL,
+		AzureURL: rc.CIDRAzureURL,
+		OnRefresh: func(source string, ok bool, at time.Time) {
+			m.observeCIDRRefresh(source, ok, at)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// backendMapper is non-nil when the operator has configured one or
+	// more pluggable blob-mirror backends; otherwise we fall back to the
+	// legacy AWS-only bucket lookup below.
+	backendMapper := loadBackendMapper(rc)
+
+	trustedProxies := clientip.TrustedProxies(rc.TrustedProxyCIDRs)
+	getClientIP := func(r *http.Request) (netip.Addr, error) {
+		return clientip.Get(r, trustedProxies)
+	}
+	// resolver tries, in order: an explicit X-Client-Region/X-Client-Cloud
+	// override, an EDNS-client-subnet-like hint from a trusted CDN front,
+	// and finally the cloud IP range trie -- all gated on the request's
+	// immediate peer being a trusted proxy, except the trie lookup which
+	// applies to every request.
+	resolver := cloudcidrs.ChainResolver{
+		cloudcidrs.HeaderResolver{TrustedProxies: trustedProxies, PeerIP: clientip.Peer},
+		cloudcidrs.EDNSSubnetResolver{TrustedProxies: trustedProxies, PeerIP: clientip.Peer, Mapper: regionMapper, HeaderName: rc.EDNSSubnetHeader},
+		cloudcidrs.TrieResolver{Mapper: regionMapper, ClientIP: getClientIP},
+	}
 	// capture these in a http handler lambda
 	return func(w http.ResponseWriter, r *http.Request) {
 		rPath := r.URL.Path
 		// check the client IP and determine the best backend
 		// It is also crucial for oauth2 token validation
-		clientIP, err := clientip.Get(r)
-		if err != nil {
+		if _, err := getClientIP(r); err != nil {
 			// this should not happen
 			klog.ErrorS(err, "failed to get client IP")
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		// Stay in the same cloud provider
-		ipInfo, ipIsKnown := regionMapper.GetIP(clientIP)
+		ipInfo, ipIsKnown := resolver.Resolve(r)
 
 		// we only care about publicly readable GCR as the backing registry
 		// or publicly readable blob storage
@@ -114,6 +196,7 @@ func makeV2Handler(rc RegistryConfig, blobs blobChecker) func(w http.ResponseWri
 				// Azure actually cares about auth tokens for the /v2/ API call
 				redirectURL := redirectUpstream(rc, rPath, ipInfo)
 				klog.V(2).Infof("redirecting oauth request to %s", redirectURL)
+				m.observeRedirect(ipInfo.Cloud, ipInfo.Region)
 				http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 				return
 			}
@@ -137,30 +220,57 @@ func makeV2Handler(rc RegistryConfig, blobs blobChecker) func(w http.ResponseWri
 			// not a blob request so forward it to the main upstream registry
 			redirectURL := redirectUpstream(rc, rPath, ipInfo)
 			klog.V(2).Infof("redirecting manifest request to %s", redirectURL)
+			m.observeRedirect(ipInfo.Cloud, ipInfo.Region)
 			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 			return
 		}
 		// it is a blob request, grab the hash for later
 		digest := matches[1]
 
+		region := ""
+		if ipIsKnown {
+			region = ipInfo.Region
+		}
+
+		// if the operator has configured pluggable blob backends, prefer
+		// those over the legacy AWS-only bucket lookup below: pick the
+		// backend closest to the client and check it directly.
+		if backendMapper != nil {
+			if b := backendMapper.Closest(ipInfo.Cloud, region); b != nil {
+				exists, err := blobs.BackendBlobExists(r.Context(), b, digest)
+				if err != nil {
+					klog.ErrorS(err, "backend blob existence check failed", "backend", b.Name())
+				} else if exists {
+					blobURL := presignedOrPublicBlobURL(r.Context(), rc, b, digest)
+					klog.V(2).Infof("%s: redirecting blob request to %s", b.Name(), blobURL)
+					m.observeRedirect(ipInfo.Cloud, region)
+					http.Redirect(w, r, blobURL, http.StatusTemporaryRedirect)
+					return
+				}
+			}
+			redirectURL := redirectUpstream(rc, rPath, ipInfo)
+			klog.V(2).InfoS("redirecting blob request to upstream registry", "path", rPath, "redirect", redirectURL)
+			m.observeRedirect(ipInfo.Cloud, ipInfo.Region)
+			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+			return
+		}
+
 		if ipIsKnown && ipInfo.Cloud != cloudcidrs.AWS {
 			redirectURL := redirectUpstream(rc, rPath, ipInfo)
 			klog.V(2).Infof("redirecting blob request to %s", redirectURL)
+			m.observeRedirect(ipInfo.Cloud, ipInfo.Region)
 			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 			return
 		}
 
 		// check if blob is available in our AWS layer storage for the region
-		region := ""
-		if ipIsKnown {
-			region = ipInfo.Region
-		}
 		bucketURL := awsRegionToHostURL(region, rc.DefaultAWSBaseURL)
 		// this matches GCR's GCS layout, which we will use for other buckets
 		blobURL := bucketURL + "/containers/images/" + digest
 		if blobs.BlobExists(blobURL) {
 			// blob known to be available in AWS, redirect client there
 			klog.V(2).Infof("AWS: redirecting blob request to %s", blobURL)
+			m.observeRedirect(cloudcidrs.AWS, region)
 			http.Redirect(w, r, blobURL, http.StatusTemporaryRedirect)
 			return
 		}
@@ -168,6 +278,7 @@ func makeV2Handler(rc RegistryConfig, blobs blobChecker) func(w http.ResponseWri
 		// fall back to redirect to upstream
 		redirectURL := redirectUpstream(rc, rPath, ipInfo)
 		klog.V(2).InfoS("redirecting blob request to upstream registry", "path", rPath, "redirect", redirectURL)
+		m.observeRedirect(ipInfo.Cloud, ipInfo.Region)
 		http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 	}
 }
@@ -212,3 +323,44 @@ func redirectUpstream(rc RegistryConfig, originalPath string, ipInfo cloudcidrs.
 	}
 	return redirectUrl
 }
+
+// presignedOrPublicBlobURL returns a short-lived presigned URL for digest
+// when b supports it, falling back to b's plain (assumed public) URL
+// otherwise or if presigning fails.
+func presignedOrPublicBlobURL(ctx context.Context, rc RegistryConfig, b backend.Backend, digest string) string {
+	presigner, ok := b.(backend.Presigner)
+	if !ok {
+		return b.BlobURL(digest)
+	}
+	expiry := rc.PresignExpiry
+	if expiry <= 0 {
+		expiry = backend.DefaultPresignExpiry
+	}
+	url, err := presigner.PresignBlobURL(ctx, digest, expiry)
+	if err != nil {
+		klog.ErrorS(err, "failed to presign blob URL, falling back to public URL", "backend", b.Name())
+		return b.BlobURL(digest)
+	}
+	return url
+}
+
+// loadBackendMapper builds a backend.Mapper from rc.BackendsConfigPath.
+// It returns nil (not an error) when no path is configured, so callers can
+// use its presence to decide whether to use the pluggable backend path or
+// fall back to the legacy AWS-only behavior. A configured path that fails
+// to load is a startup-time misconfiguration and panics, consistent with
+// how cloudcidrs.NewIPMapper treats its own data files.
+func loadBackendMapper(rc RegistryConfig) *backend.Mapper {
+	if rc.BackendsConfigPath == "" {
+		return nil
+	}
+	cfg, err := backend.LoadConfig(rc.BackendsConfigPath)
+	if err != nil {
+		panic(err)
+	}
+	backends, err := cfg.Build()
+	if err != nil {
+		panic(err)
+	}
+	return backend.NewMapper(backends)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds all of the Prometheus collectors archeio exposes on /metrics.
+//
+// MakeHandler constructs one with newMetrics() and every request-handling
+// goroutine shares it. Each newMetrics() call registers against its own
+// fresh registry, so tests that construct one get an isolated registry.
+type metrics struct {
+	registry *prometheus.Registry
+
+	redirectsTotal *prometheus.CounterVec
+	responsesTotal *prometheus.CounterVec
+
+	blobCacheHitsTotal      *prometheus.CounterVec
+	blobCacheMissesTotal    *prometheus.CounterVec
+	blobCacheEvictionsTotal *prometheus.CounterVec
+	blobHeadDuration        *prometheus.HistogramVec
+	blobHeadFailureTotal    *prometheus.CounterVec
+
+	cidrRefreshTotal            *prometheus.CounterVec
+	cidrLastRefreshSuccessGauge *prometheus.GaugeVec
+}
+
+// newMetrics constructs and registers the archeio Prometheus collectors
+// against a fresh registry.
+func newMetrics() *metrics {
+	reg := prometheus.NewRegistry()
+	m := &metrics{
+		registry: reg,
+		redirectsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "archeio_redirects_total",
+			Help: "Number of redirect decisions made, by destination cloud and region.",
+		}, []string{"cloud", "region"}),
+		responsesTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "archeio_http_responses_total",
+			Help: "Number of HTTP responses served, by status code class.",
+		}, []string{"code"}),
+		blobCacheHitsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "archeio_blob_cache_hits_total",
+			Help: "Number of blob existence checks served from cache.",
+		}, []string{"cloud"}),
+		blobCacheMissesTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "archeio_blob_cache_misses_total",
+			Help: "Number of blob existence checks that required an upstream HEAD.",
+		}, []string{"cloud"}),
+		blobCacheEvictionsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "archeio_blob_cache_evictions_total",
+			Help: "Number of blob cache entries evicted for exceeding the configured cache size.",
+		}, []string{"cloud"}),
+		blobHeadDuration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "archeio_blob_head_duration_seconds",
+			Help:    "Latency of upstream HEAD requests used to check blob existence.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"cloud"}),
+		blobHeadFailureTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "archeio_blob_head_failures_total",
+			Help: "Number of upstream HEAD requests that failed outright (not just a non-200).",
+		}, []string{"cloud"}),
+		cidrRefreshTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "archeio_cidr_refresh_total",
+			Help: "Number of cloud IP range refresh attempts, by source and result.",
+		}, []string{"source", "result"}),
+		cidrLastRefreshSuccessGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "archeio_cidr_last_refresh_success_timestamp_seconds",
+			Help: "Unix timestamp of the last successful cloud IP range refresh, by source.",
+		}, []string{"source"}),
+	}
+	return m
+}
+
+// observeCIDRRefresh records the outcome of a cloud IP range refresh
+// attempt for the given source ("aws", "gcp", "azure").
+func (m *metrics) observeCIDRRefresh(source string, ok bool, at time.Time) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	m.cidrRefreshTotal.WithLabelValues(source, result).Inc()
+	if ok {
+		m.cidrLastRefreshSuccessGauge.WithLabelValues(source).Set(float64(at.Unix()))
+	}
+}
+
+// observeRedirect records a redirect decision to the given cloud/region pair.
+// region may be empty when the destination is not region-scoped (e.g. GCR).
+func (m *metrics) observeRedirect(cloud, region string) {
+	m.redirectsTotal.WithLabelValues(cloud, region).Inc()
+}
+
+// statusRecorder wraps http.ResponseWriter so we can observe the status
+// code actually written, since http.Redirect/http.Error don't return it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentResponses wraps a handler, recording a counter for every
+// response by status code class (2xx, 3xx, 4xx, 5xx).
+func (m *metrics) instrumentResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		m.responsesTotal.WithLabelValues(statusClass(rec.status)).Inc()
+	}
+}
+
+func statusClass(code int) string {
+	switch {
+	case code >= 200 && code < 300:
+		return "2xx"
+	case code >= 300 && code < 400:
+		return "3xx"
+	case code >= 400 && code < 500:
+		return "4xx"
+	case code >= 500:
+		return "5xx"
+	default:
+		return "unknown"
+	}
+}
+
+// metricsHandler returns the promhttp handler for this metrics registry.
+func (m *metrics) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// healthzHandler always reports healthy once the process is serving
+// requests: archeio has no external dependencies that must be up to
+// consider it live.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// readyzHandler reports readiness. archeio has no startup dependencies to
+// wait on today, so readiness mirrors liveness; this is kept as a distinct
+// endpoint so a future dependency (e.g. a populated IP map) has somewhere
+// to plug in without changing the contract operators depend on.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
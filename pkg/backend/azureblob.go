@@ -0,0 +1,159 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+)
+
+// udcValidity is how long a requested Azure user delegation credential is
+// valid for (Azure allows up to 7 days); udcRefreshSlack is how far ahead
+// of its own expiry we proactively refresh it, so a presign call never
+// races a credential expiring mid-request.
+const (
+	udcValidity     = 24 * time.Hour
+	udcRefreshSlack = time.Hour
+)
+
+// AzureBlobConfig configures an Azure Blob Storage-backed Backend.
+type AzureBlobConfig struct {
+	// AccountURL is the blob service endpoint, e.g.
+	// "https://<account>.blob.core.windows.net".
+	AccountURL string `json:"accountURL"`
+	// Container is the blob container blobs are mirrored into.
+	Container string `json:"container"`
+	// KeyPrefix is prepended to the blob digest to form the blob name.
+	KeyPrefix string `json:"keyPrefix"`
+}
+
+type azureBlobBackend struct {
+	name       string
+	affinities []Affinity
+	cfg        AzureBlobConfig
+	client     *azblob.Client
+
+	udcMu     sync.Mutex
+	udc       *sas.UserDelegationCredential
+	udcExpiry time.Time
+}
+
+func newAzureBlobBackend(name string, affinities []Affinity, cfg AzureBlobConfig) (Backend, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("loading Azure credential: %w", err)
+	}
+	client, err := azblob.NewClient(cfg.AccountURL, cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating Azure Blob client: %w", err)
+	}
+	return &azureBlobBackend{
+		name:       name,
+		affinities: affinities,
+		cfg:        cfg,
+		client:     client,
+	}, nil
+}
+
+func (b *azureBlobBackend) Name() string           { return b.name }
+func (b *azureBlobBackend) Affinities() []Affinity { return b.affinities }
+
+func (b *azureBlobBackend) BlobURL(digest string) string {
+	return b.cfg.AccountURL + "/" + b.cfg.Container + "/" + b.cfg.KeyPrefix + digest
+}
+
+func (b *azureBlobBackend) BlobExists(ctx context.Context, digest string) (bool, error) {
+	blobName := b.cfg.KeyPrefix + digest
+	_, err := b.client.ServiceClient().NewContainerClient(b.cfg.Container).NewBlobClient(blobName).GetProperties(ctx, nil)
+	if err == nil {
+		return true, nil
+	}
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// PresignBlobURL implements Presigner using an Azure user-delegation SAS,
+// so no storage account key needs to be configured: the SAS is signed
+// using the same Azure AD credential used for the existence check.
+func (b *azureBlobBackend) PresignBlobURL(ctx context.Context, digest string, expiry time.Duration) (string, error) {
+	blobName := b.cfg.KeyPrefix + digest
+	now := time.Now().UTC().Add(-5 * time.Minute) // clock skew slack, matches Azure SAS guidance
+	sasExpiry := time.Now().UTC().Add(expiry)
+
+	udc, udcExpiry, err := b.userDelegationCredential(ctx, sasExpiry)
+	if err != nil {
+		return "", err
+	}
+	// a SAS can't outlive the delegation credential it's signed with
+	if sasExpiry.After(udcExpiry) {
+		sasExpiry = udcExpiry
+	}
+
+	sasValues := sas.BlobSignatureValues{
+		Protocol:      sas.ProtocolHTTPS,
+		StartTime:     now,
+		ExpiryTime:    sasExpiry,
+		Permissions:   (&sas.BlobPermissions{Read: true}).String(),
+		ContainerName: b.cfg.Container,
+		BlobName:      blobName,
+	}
+	query, err := sasValues.SignWithUserDelegation(udc)
+	if err != nil {
+		return "", fmt.Errorf("signing Azure SAS for %s/%s: %w", b.cfg.Container, blobName, err)
+	}
+	return fmt.Sprintf("%s/%s/%s?%s", b.cfg.AccountURL, b.cfg.Container, blobName, query.Encode()), nil
+}
+
+// userDelegationCredential returns a cached Azure user delegation
+// credential good until at least neededUntil, fetching a fresh one (valid
+// for udcValidity) only when the cached one doesn't cover neededUntil or
+// is within udcRefreshSlack of its own expiry. Without this, every single
+// presign call would be a live IAM round trip, including ones served
+// straight from a cache hit in the caller's blobCache.
+func (b *azureBlobBackend) userDelegationCredential(ctx context.Context, neededUntil time.Time) (*sas.UserDelegationCredential, time.Time, error) {
+	b.udcMu.Lock()
+	defer b.udcMu.Unlock()
+
+	if b.udc != nil && b.udcExpiry.After(neededUntil) && time.Now().Before(b.udcExpiry.Add(-udcRefreshSlack)) {
+		return b.udc, b.udcExpiry, nil
+	}
+
+	start := time.Now().UTC().Add(-5 * time.Minute) // clock skew slack, matches Azure SAS guidance
+	expiresAt := start.Add(udcValidity)
+
+	udc, err := b.client.ServiceClient().GetUserDelegationCredential(ctx, sas.KeyInfo{
+		Start:  toPtr(start.Format(sas.TimeFormat)),
+		Expiry: toPtr(expiresAt.Format(sas.TimeFormat)),
+	}, nil)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("getting Azure user delegation credential: %w", err)
+	}
+	b.udc = udc
+	b.udcExpiry = expiresAt
+	return b.udc, b.udcExpiry, nil
+}
+
+func toPtr[T any](v T) *T { return &v }
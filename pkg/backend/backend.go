@@ -0,0 +1,205 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backend defines the pluggable blob-mirror backends archeio can
+// redirect clients to, and the config file format used to wire them up.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultPresignExpiry is how long a presigned blob URL is valid for when
+// the caller does not request a specific expiry.
+const DefaultPresignExpiry = 5 * time.Minute
+
+// Presigner is implemented by backends that can mint a short-lived signed
+// URL for a blob, so operators can host mirror buckets/containers privately
+// instead of relying on them being world-readable. Backends that cannot
+// presign (e.g. an OCI-distribution mirror, which is fetched through the
+// normal registry auth flow) simply don't implement this interface, and
+// callers fall back to Backend.BlobURL.
+type Presigner interface {
+	// PresignBlobURL returns a URL for digest that is valid for expiry,
+	// signed using this backend's native scheme (SigV4, Azure SAS, or a
+	// GCS signed URL).
+	PresignBlobURL(ctx context.Context, digest string, expiry time.Duration) (string, error)
+}
+
+// Affinity describes a (cloud, region) pair a Backend is considered close
+// to, for the purposes of picking the backend that will serve a client in
+// that region with the lowest latency.
+//
+// Region may be empty to mean "any region in this cloud".
+type Affinity struct {
+	Cloud  string `json:"cloud"`
+	Region string `json:"region"`
+}
+
+// Backend is a blob mirror archeio can redirect clients to.
+//
+// Implementations wrap a single bucket/container/registry and know how to
+// check blob existence using that backend's native protocol.
+type Backend interface {
+	// Name uniquely identifies this backend, for logging and metrics.
+	Name() string
+	// Affinities lists the (cloud, region) pairs this backend should be
+	// preferred for.
+	Affinities() []Affinity
+	// BlobExists checks whether digest is present in this backend.
+	BlobExists(ctx context.Context, digest string) (bool, error)
+	// BlobURL returns the redirect target for digest in this backend,
+	// assuming the blob is readable at that URL (e.g. a public bucket).
+	// Backends that require signed URLs implement backend.Presigner
+	// instead of relying on this being publicly fetchable.
+	BlobURL(digest string) string
+}
+
+// Config is the on-disk (YAML or JSON) description of the backends archeio
+// should mirror blobs from.
+type Config struct {
+	Backends []BackendConfig `json:"backends"`
+}
+
+// BackendConfig describes a single configured backend. Exactly one of the
+// protocol-specific fields should be set, matching Type.
+type BackendConfig struct {
+	// Type selects the backend implementation: "s3", "azureblob", "gcs", or "oci".
+	Type string `json:"type"`
+	// Name is a short identifier used in logs and metrics.
+	Name string `json:"name"`
+	// Affinities is the set of (cloud, region) pairs this backend serves.
+	Affinities []Affinity `json:"affinities"`
+
+	// CredentialsRef names an environment variable holding
+	// "username:password" basic-auth credentials, resolved at startup
+	// instead of embedding secrets in this file. Only the oci backend type
+	// consumes it today; s3, azureblob, and gcs authenticate via their
+	// SDK's own ambient credential chain (IAM role, workload identity,
+	// etc.) and ignore this field.
+	CredentialsRef string `json:"credentialsRef,omitempty"`
+
+	S3        *S3Config        `json:"s3,omitempty"`
+	AzureBlob *AzureBlobConfig `json:"azureBlob,omitempty"`
+	GCS       *GCSConfig       `json:"gcs,omitempty"`
+	OCI       *OCIConfig       `json:"oci,omitempty"`
+}
+
+// LoadConfig reads and parses a backends config file. YAML and JSON are
+// both accepted since JSON is valid YAML.
+func LoadConfig(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading backend config %q: %w", path, err)
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal(raw, c); err != nil {
+		return nil, fmt.Errorf("parsing backend config %q: %w", path, err)
+	}
+	return c, nil
+}
+
+// Build constructs a Backend for every entry in the config.
+func (c *Config) Build() ([]Backend, error) {
+	backends := make([]Backend, 0, len(c.Backends))
+	for _, bc := range c.Backends {
+		b, err := bc.build()
+		if err != nil {
+			return nil, fmt.Errorf("building backend %q: %w", bc.Name, err)
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+func (bc BackendConfig) build() (Backend, error) {
+	switch bc.Type {
+	case "s3":
+		if bc.S3 == nil {
+			return nil, fmt.Errorf("backend type s3 requires an s3 config block")
+		}
+		return newS3Backend(bc.Name, bc.Affinities, *bc.S3)
+	case "azureblob":
+		if bc.AzureBlob == nil {
+			return nil, fmt.Errorf("backend type azureblob requires an azureBlob config block")
+		}
+		return newAzureBlobBackend(bc.Name, bc.Affinities, *bc.AzureBlob)
+	case "gcs":
+		if bc.GCS == nil {
+			return nil, fmt.Errorf("backend type gcs requires a gcs config block")
+		}
+		return newGCSBackend(bc.Name, bc.Affinities, *bc.GCS)
+	case "oci":
+		if bc.OCI == nil {
+			return nil, fmt.Errorf("backend type oci requires an oci config block")
+		}
+		return newOCIBackend(bc.Name, bc.Affinities, *bc.OCI, bc.CredentialsRef)
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", bc.Type)
+	}
+}
+
+// Mapper picks the best configured Backend for a given (cloud, region).
+type Mapper struct {
+	backends []Backend
+	// byAffinity indexes backends by exact (cloud, region) for O(1) lookup
+	// before falling back to a cloud-wide wildcard match.
+	byAffinity map[Affinity][]Backend
+	// byCloud only indexes backends that advertised a wildcard affinity
+	// (Region == "") for that cloud -- a backend scoped to one specific
+	// region has no business being picked as the fallback for a different,
+	// unmatched region in the same cloud.
+	byCloud map[string][]Backend
+}
+
+// NewMapper indexes backends by their advertised affinities.
+func NewMapper(backends []Backend) *Mapper {
+	m := &Mapper{
+		backends:   backends,
+		byAffinity: map[Affinity][]Backend{},
+		byCloud:    map[string][]Backend{},
+	}
+	for _, b := range backends {
+		for _, a := range b.Affinities() {
+			if a.Region != "" {
+				m.byAffinity[a] = append(m.byAffinity[a], b)
+				continue
+			}
+			m.byCloud[a.Cloud] = append(m.byCloud[a.Cloud], b)
+		}
+	}
+	return m
+}
+
+// Closest returns the backend advertising the tightest affinity for
+// (cloud, region), preferring an exact region match, then falling back to
+// a backend that declared a wildcard affinity for that cloud. Returns nil
+// if neither matches, including when the cloud only has backends scoped to
+// other regions.
+func (m *Mapper) Closest(cloud, region string) Backend {
+	if bs, ok := m.byAffinity[Affinity{Cloud: cloud, Region: region}]; ok && len(bs) > 0 {
+		return bs[0]
+	}
+	if bs, ok := m.byCloud[cloud]; ok && len(bs) > 0 {
+		return bs[0]
+	}
+	return nil
+}
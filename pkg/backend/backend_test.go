@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"testing"
+)
+
+// fakeBackend is a minimal Backend for exercising Mapper without a real
+// cloud SDK.
+type fakeBackend struct {
+	name       string
+	affinities []Affinity
+}
+
+func (f *fakeBackend) Name() string                 { return f.name }
+func (f *fakeBackend) Affinities() []Affinity       { return f.affinities }
+func (f *fakeBackend) BlobURL(digest string) string { return "https://example.com/" + digest }
+func (f *fakeBackend) BlobExists(ctx context.Context, digest string) (bool, error) {
+	return true, nil
+}
+
+func TestMapperClosestPrefersExactRegionMatch(t *testing.T) {
+	wildcard := &fakeBackend{name: "aws-wildcard", affinities: []Affinity{{Cloud: "AWS"}}}
+	exact := &fakeBackend{name: "aws-us-east-1", affinities: []Affinity{{Cloud: "AWS", Region: "us-east-1"}}}
+	m := NewMapper([]Backend{wildcard, exact})
+
+	if got := m.Closest("AWS", "us-east-1"); got != exact {
+		t.Fatalf("expected exact-region backend, got %v", got)
+	}
+}
+
+func TestMapperClosestFallsBackToWildcardNotUnrelatedRegion(t *testing.T) {
+	// usWest is scoped to exactly one region and must never be picked as
+	// the fallback for a different, unmatched region in the same cloud --
+	// only a backend that actually declared a wildcard affinity should be.
+	usWest := &fakeBackend{name: "aws-us-west-2", affinities: []Affinity{{Cloud: "AWS", Region: "us-west-2"}}}
+	wildcard := &fakeBackend{name: "aws-wildcard", affinities: []Affinity{{Cloud: "AWS"}}}
+	m := NewMapper([]Backend{usWest, wildcard})
+
+	if got := m.Closest("AWS", "eu-west-1"); got != wildcard {
+		t.Fatalf("expected wildcard backend for unmatched region, got %v", got)
+	}
+}
+
+func TestMapperClosestNoBackendForCloud(t *testing.T) {
+	m := NewMapper([]Backend{&fakeBackend{name: "aws-wildcard", affinities: []Affinity{{Cloud: "AWS"}}}})
+
+	if got := m.Closest("GCP", "us-central1"); got != nil {
+		t.Fatalf("expected nil for a cloud with no configured backend, got %v", got)
+	}
+}
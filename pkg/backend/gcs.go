@@ -0,0 +1,172 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	credentials "cloud.google.com/go/iam/credentials/apiv1"
+	"cloud.google.com/go/iam/credentials/apiv1/credentialspb"
+	"cloud.google.com/go/storage"
+)
+
+// GCSConfig configures a Google Cloud Storage-backed Backend.
+type GCSConfig struct {
+	// Bucket is the GCS bucket blobs are mirrored into.
+	Bucket string `json:"bucket"`
+	// KeyPrefix is prepended to the blob digest to form the object name.
+	KeyPrefix string `json:"keyPrefix"`
+	// BaseURL is the public URL used to build redirect targets, e.g.
+	// "https://storage.googleapis.com/<bucket>".
+	BaseURL string `json:"baseURL"`
+	// ServiceAccountEmail, if set, is used to sign presigned URLs via the
+	// IAM Credentials API's signBlob, so no private key file needs to be
+	// distributed to archeio. Required for PresignBlobURL.
+	ServiceAccountEmail string `json:"serviceAccountEmail,omitempty"`
+}
+
+type gcsBackend struct {
+	name       string
+	affinities []Affinity
+	cfg        GCSConfig
+	client     *storage.Client
+	iamClient  *credentials.IamCredentialsClient
+
+	signMu    sync.Mutex
+	signCache map[string]signedURLEntry
+}
+
+// signedURLEntry is a cached GCS V4 signed URL for one object.
+type signedURLEntry struct {
+	url       string
+	expiresAt time.Time
+}
+
+func newGCSBackend(name string, affinities []Affinity, cfg GCSConfig) (Backend, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("creating GCS client: %w", err)
+	}
+	var iamClient *credentials.IamCredentialsClient
+	if cfg.ServiceAccountEmail != "" {
+		iamClient, err = credentials.NewIamCredentialsClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("creating IAM credentials client: %w", err)
+		}
+	}
+	return &gcsBackend{
+		name:       name,
+		affinities: affinities,
+		cfg:        cfg,
+		client:     client,
+		iamClient:  iamClient,
+	}, nil
+}
+
+func (b *gcsBackend) Name() string           { return b.name }
+func (b *gcsBackend) Affinities() []Affinity { return b.affinities }
+
+func (b *gcsBackend) BlobURL(digest string) string {
+	return b.cfg.BaseURL + "/" + b.cfg.KeyPrefix + digest
+}
+
+func (b *gcsBackend) BlobExists(ctx context.Context, digest string) (bool, error) {
+	obj := b.client.Bucket(b.cfg.Bucket).Object(b.cfg.KeyPrefix + digest)
+	_, err := obj.Attrs(ctx)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+// PresignBlobURL implements Presigner using a V4 signed URL, signed
+// on-the-fly via the IAM Credentials API so archeio never holds a GCS
+// service account private key.
+//
+// The signed URL is cached per object and reused across calls (including
+// ones triggered by a blobCache hit, which would otherwise turn every
+// redirect into a live SignBlob round trip) until less than half of its
+// validity window remains, at which point it's re-signed.
+func (b *gcsBackend) PresignBlobURL(ctx context.Context, digest string, expiry time.Duration) (string, error) {
+	if b.iamClient == nil {
+		return "", fmt.Errorf("gcs backend %q has no serviceAccountEmail configured for signing", b.name)
+	}
+	objectName := b.cfg.KeyPrefix + digest
+
+	if url, ok := b.cachedSignedURL(objectName, expiry); ok {
+		return url, nil
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	opts := &storage.SignedURLOptions{
+		Scheme:         storage.SigningSchemeV4,
+		Method:         http.MethodGet,
+		Expires:        expiresAt,
+		GoogleAccessID: b.cfg.ServiceAccountEmail,
+		SignBytes: func(payload []byte) ([]byte, error) {
+			resp, err := b.iamClient.SignBlob(ctx, &credentialspb.SignBlobRequest{
+				Name:    "projects/-/serviceAccounts/" + b.cfg.ServiceAccountEmail,
+				Payload: payload,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return resp.SignedBlob, nil
+		},
+	}
+	url, err := storage.SignedURL(b.cfg.Bucket, objectName, opts)
+	if err != nil {
+		return "", fmt.Errorf("signing GCS URL for gs://%s/%s: %w", b.cfg.Bucket, objectName, err)
+	}
+	b.cacheSignedURL(objectName, url, expiresAt)
+	return url, nil
+}
+
+// cachedSignedURL returns a still-usable cached signed URL for objectName.
+// A cached URL stops being usable once less than half of its original
+// expiry window remains, so a client is never handed a redirect that's
+// about to lapse mid-fetch.
+func (b *gcsBackend) cachedSignedURL(objectName string, expiry time.Duration) (string, bool) {
+	b.signMu.Lock()
+	defer b.signMu.Unlock()
+	entry, ok := b.signCache[objectName]
+	if !ok {
+		return "", false
+	}
+	if time.Until(entry.expiresAt) < expiry/2 {
+		delete(b.signCache, objectName)
+		return "", false
+	}
+	return entry.url, true
+}
+
+func (b *gcsBackend) cacheSignedURL(objectName, url string, expiresAt time.Time) {
+	b.signMu.Lock()
+	defer b.signMu.Unlock()
+	if b.signCache == nil {
+		b.signCache = map[string]signedURLEntry{}
+	}
+	b.signCache[objectName] = signedURLEntry{url: url, expiresAt: expiresAt}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// S3Config configures an S3-backed Backend.
+type S3Config struct {
+	// Bucket is the S3 bucket name blobs are mirrored into.
+	Bucket string `json:"bucket"`
+	// Region is the AWS region the bucket lives in.
+	Region string `json:"region"`
+	// KeyPrefix is prepended to the blob digest to form the object key,
+	// matching the layout archeio already uses for AWS buckets.
+	KeyPrefix string `json:"keyPrefix"`
+	// BaseURL is the public URL used to build redirect targets, e.g.
+	// "https://containerimageregistry.s3.us-east-1.amazonaws.com".
+	BaseURL string `json:"baseURL"`
+}
+
+type s3Backend struct {
+	name       string
+	affinities []Affinity
+	cfg        S3Config
+	client     *s3.Client
+	presign    *s3.PresignClient
+}
+
+func newS3Backend(name string, affinities []Affinity, cfg S3Config) (Backend, error) {
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	client := s3.NewFromConfig(awsCfg)
+	return &s3Backend{
+		name:       name,
+		affinities: affinities,
+		cfg:        cfg,
+		client:     client,
+		presign:    s3.NewPresignClient(client),
+	}, nil
+}
+
+func (b *s3Backend) Name() string           { return b.name }
+func (b *s3Backend) Affinities() []Affinity { return b.affinities }
+func (b *s3Backend) BlobURL(digest string) string {
+	return b.cfg.BaseURL + "/" + b.cfg.KeyPrefix + digest
+}
+
+func (b *s3Backend) BlobExists(ctx context.Context, digest string) (bool, error) {
+	key := b.cfg.KeyPrefix + digest
+	_, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.cfg.Bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
+		return false, nil
+	}
+	return false, err
+}
+
+// PresignBlobURL implements Presigner using an AWS SigV4 presigned GET.
+func (b *s3Backend) PresignBlobURL(ctx context.Context, digest string, expiry time.Duration) (string, error) {
+	key := b.cfg.KeyPrefix + digest
+	req, err := b.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.cfg.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", fmt.Errorf("presigning s3://%s/%s: %w", b.cfg.Bucket, key, err)
+	}
+	return req.URL, nil
+}
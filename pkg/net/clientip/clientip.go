@@ -0,0 +1,108 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package clientip determines the real client IP for an incoming request.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies is a set of CIDRs that are trusted to have set an
+// accurate X-Forwarded-For header. A nil or empty TrustedProxies means no
+// proxy is trusted, so Get always returns the immediate TCP peer.
+type TrustedProxies []netip.Prefix
+
+// Trusts reports whether ip belongs to a trusted proxy.
+func (tp TrustedProxies) Trusts(ip netip.Addr) bool {
+	for _, p := range tp {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the real client IP for r.
+//
+// With no trusted proxies configured, this is always the immediate TCP
+// peer (r.RemoteAddr): an X-Forwarded-For header cannot be trusted to be
+// anything but client-supplied in that case.
+//
+// With trusted proxies configured, and only when the immediate peer is
+// itself a trusted proxy, Get walks the X-Forwarded-For chain from right
+// (closest hop) to left, skipping entries contributed by trusted proxies,
+// and returns the first hop that isn't trusted -- the earliest point in
+// the chain archeio still has confidence in. If every hop is trusted (or
+// the header is missing or malformed) Get falls back to the immediate
+// peer.
+func Get(r *http.Request, trusted TrustedProxies) (netip.Addr, error) {
+	peer, err := remoteAddrIP(r)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(trusted) == 0 || !trusted.Trusts(peer) {
+		return peer, nil
+	}
+
+	xff := r.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return peer, nil
+	}
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip, err := netip.ParseAddr(hop)
+		if err != nil {
+			// a malformed hop breaks our confidence in the rest of the
+			// chain; stop here rather than guess past it
+			break
+		}
+		if !trusted.Trusts(ip) {
+			return ip, nil
+		}
+	}
+	return peer, nil
+}
+
+func remoteAddrIP(r *http.Request) (netip.Addr, error) {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("parsing remote addr %q: %w", r.RemoteAddr, err)
+	}
+	return ip, nil
+}
+
+// Peer returns r's immediate TCP peer, ignoring X-Forwarded-For entirely.
+//
+// This is the right thing to check a trusted-proxy allowlist against, not
+// the result of Get: Get deliberately walks a trusted proxy's
+// X-Forwarded-For chain down to the real end-client IP, so by design it
+// usually returns an address that is *not* in the allowlist. Callers that
+// need to decide whether to honor a header the immediate peer set on this
+// request (rather than a header describing the far end client) must gate
+// on Peer, not on Get's result.
+func Peer(r *http.Request) (netip.Addr, error) {
+	return remoteAddrIP(r)
+}
@@ -37,8 +37,11 @@ type regionPrefixMapper map[string][]netip.Prefix
 
 // NewIPMapper returns cidrs.IPMapper populated with cloud region info
 // for the clouds we have resources for, currently GCP and AWS
+//
+// This reads the on-disk data files once at startup and never updates
+// them; prefer NewAutoRefreshingIPMapper for long-running deployments so
+// new cloud IP ranges don't require a redeploy to pick up.
 func NewIPMapper() cidrs.IPMapper[IPInfo] {
-	t := cidrs.NewTrieMap[IPInfo]()
 	dataDir := os.Getenv("DATA_DIR")
 	if dataDir == "" {
 		dataDir = "./data"
@@ -47,19 +50,32 @@ func NewIPMapper() cidrs.IPMapper[IPInfo] {
 	awsRaw := mustReadFile(filepath.Join(dataDir, "aws-ip-ranges.json"))
 	gcpRaw := mustReadFile(filepath.Join(dataDir, "gcp-cloud.json"))
 	azRaw := mustReadFile(filepath.Join(dataDir, "azure-cloud.json"))
+	t, err := buildTrieMap(awsRaw, gcpRaw, azRaw)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// buildTrieMap parses the raw AWS/GCP/Azure IP range documents and
+// assembles them into a single cidrs.IPMapper, without touching disk or
+// the network. It is shared by NewIPMapper and the background refresher
+// in refresh.go so both build the trie the exact same way.
+func buildTrieMap(awsRaw, gcpRaw, azRaw string) (cidrs.IPMapper[IPInfo], error) {
+	t := cidrs.NewTrieMap[IPInfo]()
 	// parse raw AWS IP range data
 	awsRTP, err := parseAWS(awsRaw)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	// parse GCP IP range data
 	gcpRTP, err := parseGCP(gcpRaw)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	azRTP, err := parseAZ(azRaw)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	for region, prefixes := range awsRTP {
@@ -77,7 +93,17 @@ func NewIPMapper() cidrs.IPMapper[IPInfo] {
 			t.Insert(prefix, IPInfo{Region: region, Cloud: AZ})
 		}
 	}
-	return t
+	return t, nil
+}
+
+// prefixCount returns the total number of prefixes across all regions in
+// a regionPrefixMapper, used for the refresher's minimum-prefix sanity check.
+func prefixCount(rtp regionPrefixMapper) int {
+	n := 0
+	for _, prefixes := range rtp {
+		n += len(prefixes)
+	}
+	return n
 }
 
 // AllIPInfos returns a slice of all known results that a NewIPMapper could
@@ -0,0 +1,348 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudcidrs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"k8s.io/registry.k8s.io/pkg/net/cidrs"
+)
+
+const (
+	// DefaultAWSIPRangesURL is where AWS publishes its IP range data.
+	DefaultAWSIPRangesURL = "https://ip-ranges.amazonaws.com/ip-ranges.json"
+	// DefaultGCPCloudURL is where Google publishes its Cloud IP range data.
+	DefaultGCPCloudURL = "https://www.gstatic.com/ipranges/cloud.json"
+	// DefaultRefreshInterval is how often the background refresher
+	// re-fetches upstream IP range data when no interval is configured.
+	DefaultRefreshInterval = 6 * time.Hour
+
+	// minPrefixCountSanity is the fewest prefixes a refreshed dataset may
+	// contain before it is rejected as obviously truncated or corrupt.
+	minPrefixCountSanity = 10
+
+	fetchTimeout = 30 * time.Second
+	// maxDatasetBytes bounds how much of a response body we'll read, so a
+	// misbehaving upstream can't exhaust memory.
+	maxDatasetBytes = 64 << 20
+)
+
+// RefreshConfig controls NewAutoRefreshingIPMapper's background refresher.
+type RefreshConfig struct {
+	// Interval is how often to re-fetch upstream data. Defaults to
+	// DefaultRefreshInterval.
+	Interval time.Duration
+	// AWSURL/GCPURL/AzureURL are the upstream documents to fetch.
+	// AWSURL and GCPURL default to the constants above. AzureURL has no
+	// default: Azure publishes ServiceTags behind a versioned download
+	// link that changes per release, so operators must supply it
+	// (leaving it empty disables refreshing Azure data; the last known
+	// snapshot on disk keeps being used).
+	AWSURL   string
+	GCPURL   string
+	AzureURL string
+	// DataDir is where the last-good snapshot of each document is
+	// persisted, so a restart with no network access can still come up
+	// warm. Defaults to $DATA_DIR, or "./data".
+	DataDir string
+	// OnRefresh, if set, is called with the outcome for each source
+	// ("aws", "gcp", "azure") a refresh attempt reaches, so callers can
+	// wire up metrics without this package depending on prometheus
+	// directly. An attempt stops at the first source that fails, so later
+	// sources are not reported for that attempt, and "azure" is only
+	// reported when AzureURL is set.
+	OnRefresh func(source string, ok bool, at time.Time)
+}
+
+func (cfg RefreshConfig) withDefaults() RefreshConfig {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultRefreshInterval
+	}
+	if cfg.AWSURL == "" {
+		cfg.AWSURL = DefaultAWSIPRangesURL
+	}
+	if cfg.GCPURL == "" {
+		cfg.GCPURL = DefaultGCPCloudURL
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = os.Getenv("DATA_DIR")
+		if cfg.DataDir == "" {
+			cfg.DataDir = "./data"
+		}
+	}
+	return cfg
+}
+
+// AutoRefreshingIPMapper is a cidrs.IPMapper backed by a background
+// goroutine that periodically re-fetches AWS/GCP/Azure IP range data and
+// atomically swaps in a newly built trie, so in-flight lookups are never
+// blocked by a refresh and never see a half-built map.
+type AutoRefreshingIPMapper struct {
+	cfg RefreshConfig
+
+	current atomic.Pointer[cidrs.IPMapper[IPInfo]]
+
+	lastSuccess     atomic.Pointer[time.Time]
+	lastAWSSyncTok  atomic.Int64
+	lastAZChangeNum atomic.Int64
+}
+
+// NewAutoRefreshingIPMapper seeds an IP mapper from the on-disk snapshot
+// in cfg.DataDir (the same files NewIPMapper reads) and starts a
+// background goroutine that keeps it current. The returned mapper is
+// immediately usable; the first network refresh happens after
+// cfg.Interval.
+func NewAutoRefreshingIPMapper(cfg RefreshConfig) (*AutoRefreshingIPMapper, error) {
+	cfg = cfg.withDefaults()
+
+	awsRaw, err := os.ReadFile(filepath.Join(cfg.DataDir, "aws-ip-ranges.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading initial AWS snapshot: %w", err)
+	}
+	gcpRaw, err := os.ReadFile(filepath.Join(cfg.DataDir, "gcp-cloud.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading initial GCP snapshot: %w", err)
+	}
+	azRaw, err := os.ReadFile(filepath.Join(cfg.DataDir, "azure-cloud.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading initial Azure snapshot: %w", err)
+	}
+
+	t, err := buildTrieMap(string(awsRaw), string(gcpRaw), string(azRaw))
+	if err != nil {
+		return nil, fmt.Errorf("building initial IP map: %w", err)
+	}
+
+	m := &AutoRefreshingIPMapper{cfg: cfg}
+	m.current.Store(&t)
+
+	go m.refreshLoop()
+	return m, nil
+}
+
+// GetIP implements cidrs.IPMapper by delegating to whichever trie is
+// currently active.
+func (m *AutoRefreshingIPMapper) GetIP(ip netip.Addr) (IPInfo, bool) {
+	return (*m.current.Load()).GetIP(ip)
+}
+
+// LastSuccess returns the time of the last refresh that updated the
+// active map, or the zero time if no background refresh has succeeded yet
+// (the initial on-disk snapshot is always loaded synchronously, though).
+func (m *AutoRefreshingIPMapper) LastSuccess() time.Time {
+	if t := m.lastSuccess.Load(); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+func (m *AutoRefreshingIPMapper) refreshLoop() {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.refreshOnce()
+	}
+}
+
+func (m *AutoRefreshingIPMapper) refreshOnce() {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	client := &http.Client{Timeout: fetchTimeout}
+
+	awsRaw, err := fetchURL(ctx, client, m.cfg.AWSURL)
+	if err != nil {
+		m.report("aws", false)
+		klog.ErrorS(err, "failed to fetch AWS IP ranges")
+		return
+	}
+	if err := m.validateAWS(awsRaw); err != nil {
+		m.report("aws", false)
+		klog.ErrorS(err, "rejecting refreshed AWS IP ranges")
+		return
+	}
+
+	gcpRaw, err := fetchURL(ctx, client, m.cfg.GCPURL)
+	if err != nil {
+		m.report("gcp", false)
+		klog.ErrorS(err, "failed to fetch GCP IP ranges")
+		return
+	}
+	if err := validatePrefixCount("gcp", gcpRaw, parseGCP); err != nil {
+		m.report("gcp", false)
+		klog.ErrorS(err, "rejecting refreshed GCP IP ranges")
+		return
+	}
+
+	azRaw, haveFreshAzure, err := m.fetchAzure(ctx, client)
+	if err != nil {
+		m.report("azure", false)
+		klog.ErrorS(err, "failed to refresh Azure IP ranges")
+		return
+	}
+
+	t, err := buildTrieMap(string(awsRaw), string(gcpRaw), string(azRaw))
+	if err != nil {
+		klog.ErrorS(err, "failed to build IP map from refreshed data")
+		m.report("aws", false)
+		m.report("gcp", false)
+		if haveFreshAzure {
+			m.report("azure", false)
+		}
+		return
+	}
+
+	var iface cidrs.IPMapper[IPInfo] = t
+	m.current.Store(&iface)
+	m.persist(awsRaw, gcpRaw, azRaw)
+
+	now := time.Now()
+	m.lastSuccess.Store(&now)
+	m.report("aws", true)
+	m.report("gcp", true)
+	if haveFreshAzure {
+		m.report("azure", true)
+	}
+	klog.InfoS("refreshed cloud IP range data", "at", now)
+}
+
+// fetchAzure fetches Azure ServiceTags if AzureURL is configured,
+// otherwise it falls back to the last persisted snapshot so the trie is
+// always rebuilt from three consistent documents. The bool return reports
+// whether a network fetch was actually attempted, for metrics purposes.
+func (m *AutoRefreshingIPMapper) fetchAzure(ctx context.Context, client *http.Client) ([]byte, bool, error) {
+	if m.cfg.AzureURL == "" {
+		raw, err := os.ReadFile(filepath.Join(m.cfg.DataDir, "azure-cloud.json"))
+		return raw, false, err
+	}
+	raw, err := fetchURL(ctx, client, m.cfg.AzureURL)
+	if err != nil {
+		return nil, true, err
+	}
+	if err := m.validateAzure(raw); err != nil {
+		return nil, true, err
+	}
+	return raw, true, nil
+}
+
+func (m *AutoRefreshingIPMapper) report(source string, ok bool) {
+	if m.cfg.OnRefresh != nil {
+		m.cfg.OnRefresh(source, ok, time.Now())
+	}
+}
+
+func fetchURL(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, url)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDatasetBytes))
+}
+
+// validateAWS checks that the refreshed AWS document parses, that its
+// syncToken has not gone backwards (AWS's syncToken is the publish time
+// as a Unix timestamp, which must only increase), and that it has a
+// plausible number of prefixes.
+func (m *AutoRefreshingIPMapper) validateAWS(raw []byte) error {
+	var meta struct {
+		SyncToken string `json:"syncToken"`
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return fmt.Errorf("invalid aws ip-ranges.json: %w", err)
+	}
+	tok, err := strconv.ParseInt(meta.SyncToken, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid aws syncToken %q: %w", meta.SyncToken, err)
+	}
+	if prev := m.lastAWSSyncTok.Load(); prev != 0 && tok < prev {
+		return fmt.Errorf("aws syncToken went backwards: %d -> %d", prev, tok)
+	}
+	if err := validatePrefixCount("aws", raw, parseAWS); err != nil {
+		return err
+	}
+	m.lastAWSSyncTok.Store(tok)
+	return nil
+}
+
+// validateAzure checks that the refreshed ServiceTags document parses,
+// that its changeNumber has not gone backwards, and that it has a
+// plausible number of prefixes.
+func (m *AutoRefreshingIPMapper) validateAzure(raw []byte) error {
+	var meta struct {
+		ChangeNumber int64 `json:"changeNumber"`
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return fmt.Errorf("invalid azure service tags document: %w", err)
+	}
+	if prev := m.lastAZChangeNum.Load(); prev != 0 && meta.ChangeNumber < prev {
+		return fmt.Errorf("azure changeNumber went backwards: %d -> %d", prev, meta.ChangeNumber)
+	}
+	if err := validatePrefixCount("azure", raw, parseAZ); err != nil {
+		return err
+	}
+	m.lastAZChangeNum.Store(meta.ChangeNumber)
+	return nil
+}
+
+// validatePrefixCount parses raw with parse and rejects it if it contains
+// implausibly few prefixes, which usually means a truncated download or a
+// format change upstream rather than a real shrink in address space.
+func validatePrefixCount(source string, raw []byte, parse func(string) (regionPrefixMapper, error)) error {
+	rtp, err := parse(string(raw))
+	if err != nil {
+		return fmt.Errorf("parsing %s data: %w", source, err)
+	}
+	if n := prefixCount(rtp); n < minPrefixCountSanity {
+		return fmt.Errorf("%s data only had %d prefixes, want at least %d", source, n, minPrefixCountSanity)
+	}
+	return nil
+}
+
+// persist writes the last-good snapshot of each document to cfg.DataDir,
+// so a restart with no network access still comes up with current data
+// instead of falling back to whatever was baked into the image.
+func (m *AutoRefreshingIPMapper) persist(awsRaw, gcpRaw, azRaw []byte) {
+	for name, raw := range map[string][]byte{
+		"aws-ip-ranges.json": awsRaw,
+		"gcp-cloud.json":     gcpRaw,
+		"azure-cloud.json":   azRaw,
+	} {
+		path := filepath.Join(m.cfg.DataDir, name)
+		if err := os.WriteFile(path, raw, 0o644); err != nil {
+			klog.ErrorS(err, "failed to persist refreshed IP range snapshot", "path", path)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudcidrs
+
+import (
+	"net/http"
+	"net/netip"
+
+	"k8s.io/registry.k8s.io/pkg/net/cidrs"
+	"k8s.io/registry.k8s.io/pkg/net/clientip"
+)
+
+// RegionResolver resolves the (cloud, region) IPInfo for the client making
+// r. It returns found=false when it has no opinion, so resolvers can be
+// chained with ChainResolver, falling back to the trie-based IPMapper
+// lookup when no override applies.
+type RegionResolver interface {
+	Resolve(r *http.Request) (IPInfo, bool)
+}
+
+// ChainResolver tries each RegionResolver in order, returning the first
+// one that has an opinion.
+type ChainResolver []RegionResolver
+
+// Resolve implements RegionResolver.
+func (c ChainResolver) Resolve(r *http.Request) (IPInfo, bool) {
+	for _, resolver := range c {
+		if info, ok := resolver.Resolve(r); ok {
+			return info, true
+		}
+	}
+	return IPInfo{}, false
+}
+
+// TrieResolver adapts a cidrs.IPMapper into a RegionResolver, so it can be
+// used as the last, always-available resolver in a ChainResolver.
+type TrieResolver struct {
+	Mapper   cidrs.IPMapper[IPInfo]
+	ClientIP func(r *http.Request) (netip.Addr, error)
+}
+
+// Resolve implements RegionResolver.
+func (t TrieResolver) Resolve(r *http.Request) (IPInfo, bool) {
+	ip, err := t.ClientIP(r)
+	if err != nil {
+		return IPInfo{}, false
+	}
+	return t.Mapper.GetIP(ip)
+}
+
+// HeaderResolver honors an explicit X-Client-Region / X-Client-Cloud
+// header, for operators running a corporate egress proxy who want all
+// pulls behind it pinned to a specific backend even though the proxy's
+// own source IP doesn't belong to a known cloud IP range. It only applies
+// the header when the request's immediate peer is a trusted proxy, so an
+// end user can't forge their way to a closer (or cheaper) bucket.
+type HeaderResolver struct {
+	TrustedProxies clientip.TrustedProxies
+	// PeerIP returns the request's immediate TCP peer (clientip.Peer),
+	// *not* the X-Forwarded-For-resolved client IP: the header is set by
+	// that peer, so trust must be checked against it directly, regardless
+	// of what end-client IP the peer's own XFF chain resolves to.
+	PeerIP func(r *http.Request) (netip.Addr, error)
+}
+
+// Resolve implements RegionResolver.
+func (h HeaderResolver) Resolve(r *http.Request) (IPInfo, bool) {
+	cloud := r.Header.Get("X-Client-Cloud")
+	if cloud == "" {
+		return IPInfo{}, false
+	}
+	peer, err := h.PeerIP(r)
+	if err != nil || !h.TrustedProxies.Trusts(peer) {
+		return IPInfo{}, false
+	}
+	return IPInfo{Cloud: cloud, Region: r.Header.Get("X-Client-Region")}, true
+}
+
+// DefaultEDNSSubnetHeader is the header EDNSSubnetResolver reads from when
+// no HeaderName is configured.
+const DefaultEDNSSubnetHeader = "X-EDNS-Client-Subnet"
+
+// EDNSSubnetResolver reads an EDNS client-subnet-like hint header set by
+// a CDN front (the same idea as the DNS EDNS0 client-subnet option: the
+// edge terminating the connection tells us the subnet of the actual end
+// user, since the TCP peer is the CDN itself) and resolves region from
+// that subnet instead of the request's client IP. Like HeaderResolver,
+// it only applies when the request's immediate peer is a trusted proxy.
+type EDNSSubnetResolver struct {
+	TrustedProxies clientip.TrustedProxies
+	// PeerIP returns the request's immediate TCP peer (clientip.Peer); see
+	// the field doc on HeaderResolver.PeerIP for why this must not be the
+	// X-Forwarded-For-resolved client IP.
+	PeerIP func(r *http.Request) (netip.Addr, error)
+	Mapper cidrs.IPMapper[IPInfo]
+	// HeaderName defaults to DefaultEDNSSubnetHeader.
+	HeaderName string
+}
+
+// Resolve implements RegionResolver.
+func (e EDNSSubnetResolver) Resolve(r *http.Request) (IPInfo, bool) {
+	headerName := e.HeaderName
+	if headerName == "" {
+		headerName = DefaultEDNSSubnetHeader
+	}
+	hint := r.Header.Get(headerName)
+	if hint == "" {
+		return IPInfo{}, false
+	}
+	peer, err := e.PeerIP(r)
+	if err != nil || !e.TrustedProxies.Trusts(peer) {
+		return IPInfo{}, false
+	}
+	addr, err := subnetAddr(hint)
+	if err != nil {
+		return IPInfo{}, false
+	}
+	return e.Mapper.GetIP(addr)
+}
+
+// subnetAddr parses hint as either a bare IP or a CIDR, returning the
+// address to look up in either case.
+func subnetAddr(hint string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(hint); err == nil {
+		return addr, nil
+	}
+	prefix, err := netip.ParsePrefix(hint)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return prefix.Addr(), nil
+}
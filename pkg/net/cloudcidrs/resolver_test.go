@@ -0,0 +1,160 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudcidrs
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"k8s.io/registry.k8s.io/pkg/net/clientip"
+)
+
+// fakeMapper is a minimal cidrs.IPMapper[IPInfo] that resolves every
+// address to the same IPInfo, for exercising EDNSSubnetResolver without
+// needing a real trie.
+type fakeMapper struct {
+	info IPInfo
+}
+
+func (f fakeMapper) GetIP(netip.Addr) (IPInfo, bool) { return f.info, true }
+
+func mustAddr(t *testing.T, s string) netip.Addr {
+	t.Helper()
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", s, err)
+	}
+	return addr
+}
+
+// newRequest builds a request with the given immediate peer and headers,
+// mirroring how a trusted proxy forwarding an X-Forwarded-For chain for an
+// untrusted end client would look.
+func newRequest(peer string, headers map[string]string) *http.Request {
+	r := &http.Request{
+		RemoteAddr: fmt.Sprintf("%s:12345", peer),
+		Header:     http.Header{},
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestHeaderResolverHonorsOverrideFromTrustedPeerWithUntrustedXFF(t *testing.T) {
+	trusted := clientip.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}
+	resolver := HeaderResolver{TrustedProxies: trusted, PeerIP: clientip.Peer}
+
+	// the immediate peer is a trusted proxy, but it's also forwarding an
+	// X-Forwarded-For chain naming an untrusted end client -- the override
+	// must still be honored, since trust is about who set the header, not
+	// about the end client clientip.Get would resolve.
+	r := newRequest("10.0.0.5", map[string]string{
+		"X-Client-Cloud":  "AWS",
+		"X-Client-Region": "us-east-1",
+		"X-Forwarded-For": "203.0.113.9",
+	})
+
+	info, ok := resolver.Resolve(r)
+	if !ok {
+		t.Fatal("expected HeaderResolver to honor the override from a trusted peer")
+	}
+	if info.Cloud != "AWS" || info.Region != "us-east-1" {
+		t.Fatalf("unexpected IPInfo: %+v", info)
+	}
+}
+
+func TestHeaderResolverRejectsOverrideFromUntrustedPeer(t *testing.T) {
+	trusted := clientip.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}
+	resolver := HeaderResolver{TrustedProxies: trusted, PeerIP: clientip.Peer}
+
+	r := newRequest("203.0.113.9", map[string]string{
+		"X-Client-Cloud":  "AWS",
+		"X-Client-Region": "us-east-1",
+	})
+
+	if _, ok := resolver.Resolve(r); ok {
+		t.Fatal("expected HeaderResolver to reject an override from an untrusted peer")
+	}
+}
+
+func TestEDNSSubnetResolverHonorsHintFromTrustedPeerWithUntrustedXFF(t *testing.T) {
+	trusted := clientip.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}
+	want := IPInfo{Cloud: GCP, Region: "asia-east1"}
+	resolver := EDNSSubnetResolver{
+		TrustedProxies: trusted,
+		PeerIP:         clientip.Peer,
+		Mapper:         fakeMapper{info: want},
+	}
+
+	r := newRequest("10.0.0.5", map[string]string{
+		DefaultEDNSSubnetHeader: "203.0.113.0/24",
+		"X-Forwarded-For":       "198.51.100.7",
+	})
+
+	info, ok := resolver.Resolve(r)
+	if !ok {
+		t.Fatal("expected EDNSSubnetResolver to honor the hint from a trusted peer")
+	}
+	if info != want {
+		t.Fatalf("unexpected IPInfo: got %+v, want %+v", info, want)
+	}
+}
+
+func TestEDNSSubnetResolverRejectsHintFromUntrustedPeer(t *testing.T) {
+	trusted := clientip.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}
+	resolver := EDNSSubnetResolver{
+		TrustedProxies: trusted,
+		PeerIP:         clientip.Peer,
+		Mapper:         fakeMapper{info: IPInfo{Cloud: GCP, Region: "asia-east1"}},
+	}
+
+	r := newRequest("203.0.113.9", map[string]string{
+		DefaultEDNSSubnetHeader: "203.0.113.0/24",
+	})
+
+	if _, ok := resolver.Resolve(r); ok {
+		t.Fatal("expected EDNSSubnetResolver to reject a hint from an untrusted peer")
+	}
+}
+
+func TestChainResolverFallsBackToTrie(t *testing.T) {
+	trusted := clientip.TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}
+	want := IPInfo{Cloud: AWS, Region: "us-east-1"}
+	chain := ChainResolver{
+		HeaderResolver{TrustedProxies: trusted, PeerIP: clientip.Peer},
+		EDNSSubnetResolver{TrustedProxies: trusted, PeerIP: clientip.Peer, Mapper: fakeMapper{info: want}},
+		TrieResolver{
+			Mapper:   fakeMapper{info: want},
+			ClientIP: func(r *http.Request) (netip.Addr, error) { return mustAddr(t, "203.0.113.9"), nil },
+		},
+	}
+
+	// no override headers set, so the chain should fall through to the
+	// trie-based TrieResolver
+	r := newRequest("203.0.113.9", nil)
+
+	info, ok := chain.Resolve(r)
+	if !ok {
+		t.Fatal("expected ChainResolver to fall back to the trie resolver")
+	}
+	if info != want {
+		t.Fatalf("unexpected IPInfo: got %+v, want %+v", info, want)
+	}
+}